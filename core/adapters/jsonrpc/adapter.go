@@ -0,0 +1,353 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+// Package jsonrpc implements a core.Adapter that speaks JSON-RPC 2.0 over a
+// single, long-lived TCP connection per handler, so a handler can both
+// receive uplinks and push downlinks without the broker having to dial it
+// back. A handler announces itself with SubscribeDownlink and pushes
+// downlinks with PushDownlink. Send forwards every uplink as a HandleData
+// call; the adapter never issues HandleJoin, which only the handler side
+// (HandlerConn) answers.
+package jsonrpc
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+
+	"github.com/TheThingsNetwork/ttn/core"
+	"github.com/TheThingsNetwork/ttn/utils/errors"
+	"github.com/apex/log"
+)
+
+// Recipient addresses a handler by its stable ID, rather than by raw,
+// transport-specific bytes, so routing survives reconnects.
+type Recipient struct {
+	HandlerID string
+}
+
+// MarshalBinary implements core.Recipient.
+func (r Recipient) MarshalBinary() ([]byte, error) {
+	return []byte(r.HandlerID), nil
+}
+
+type subscribeArgs struct {
+	HandlerID string `json:"handlerId"`
+}
+
+type handleDataArgs struct {
+	AppEUI  string `json:"appEui"`
+	DevEUI  string `json:"devEui"`
+	Payload []byte `json:"payload"`
+}
+
+type handleDataReply struct {
+	Downlink []byte `json:"downlink,omitempty"`
+}
+
+type handleJoinArgs struct {
+	AppEUI string `json:"appEui"`
+	DevEUI string `json:"devEui"`
+}
+
+type handleJoinReply struct {
+	Accept []byte `json:"accept,omitempty"`
+}
+
+type pushDownlinkArgs struct {
+	Recipient []byte `json:"recipient"`
+	Payload   []byte `json:"payload"`
+}
+
+type inboundDownlink struct {
+	packet core.Packet
+	an     core.AckNacker
+}
+
+// downlinkPacket wraps a raw downlink payload pushed by a handler together
+// with the recipient it named, so a Next() caller can tell who it's for
+// instead of the recipient being dropped on the floor.
+type downlinkPacket struct {
+	rawPacket
+	recipient []byte
+}
+
+// Recipient returns the raw recipient bytes the handler pushed this
+// downlink for.
+func (p downlinkPacket) Recipient() []byte {
+	return p.recipient
+}
+
+// Adapter is a core.Adapter backed by JSON-RPC 2.0 connections to one or
+// more handlers.
+type Adapter struct {
+	ctx      log.Interface
+	listener net.Listener
+
+	mu       sync.RWMutex
+	handlers map[string]*conn // handlerID -> connection the handler dialed in on
+
+	downlinks chan inboundDownlink
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Addr returns the address the adapter is listening on, which is useful
+// when NewAdapter was given port 0 to pick a free one.
+func (a *Adapter) Addr() string {
+	return a.listener.Addr().String()
+}
+
+// NewAdapter starts listening on bind for handlers to connect and subscribe.
+func NewAdapter(bind string, ctx log.Interface) (*Adapter, error) {
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, errors.New(errors.Operational, err)
+	}
+
+	a := &Adapter{
+		ctx:       ctx,
+		listener:  listener,
+		handlers:  make(map[string]*conn),
+		downlinks: make(chan inboundDownlink),
+		closed:    make(chan struct{}),
+	}
+	go a.accept(listener)
+	return a, nil
+}
+
+// Close stops accepting new handler connections and unblocks any Next or
+// NextRegistration call waiting on this adapter.
+func (a *Adapter) Close() error {
+	var err error
+	a.closeOnce.Do(func() {
+		err = a.listener.Close()
+		close(a.closed)
+	})
+	return err
+}
+
+func (a *Adapter) accept(listener net.Listener) {
+	for {
+		nc, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		newConn(nc, a.dispatch)
+	}
+}
+
+// dispatch answers the RPC calls a handler is allowed to make on the
+// adapter: SubscribeDownlink to register itself, PushDownlink to send one.
+func (a *Adapter) dispatch(c *conn, method string, params json.RawMessage) (interface{}, error) {
+	switch method {
+	case "Adapter.SubscribeDownlink":
+		var args subscribeArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, errors.New(errors.Structural, err)
+		}
+		a.registerHandler(args.HandlerID, c)
+		return nil, nil
+
+	case "Adapter.PushDownlink":
+		var args pushDownlinkArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, errors.New(errors.Structural, err)
+		}
+		return nil, a.pushDownlink(args)
+
+	default:
+		return nil, errors.New(errors.Structural, "Unknown method: "+method)
+	}
+}
+
+func (a *Adapter) pushDownlink(args pushDownlinkArgs) error {
+	an := &ackNacker{}
+	a.downlinks <- inboundDownlink{
+		packet: &downlinkPacket{rawPacket: rawPacket(args.Payload), recipient: args.Recipient},
+		an:     an,
+	}
+	return nil
+}
+
+// registerHandler records the connection a handler subscribed on, so Send
+// can later push uplinks to it.
+func (a *Adapter) registerHandler(handlerID string, c *conn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.handlers[handlerID] = c
+}
+
+// subscribe is called from the handler side of the connection (see
+// DialHandler) right after dialing in, to announce the handler's ID.
+func subscribe(c *conn, handlerID string) error {
+	return c.Call("Adapter.SubscribeDownlink", subscribeArgs{HandlerID: handlerID}, nil)
+}
+
+// DialHandler connects to a broker's jsonrpc.Adapter as the given handler,
+// exposing handle as the local endpoint for HandleData/HandleJoin calls and
+// subscribing under handlerID so the adapter can route uplinks to it. It's
+// the handler-side half of
+// this package, used by handlers (and by this package's tests) to drive a
+// real broker end-to-end.
+func DialHandler(addr, handlerID string, handle Handler) (*HandlerConn, error) {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, errors.New(errors.Operational, err)
+	}
+
+	hc := &HandlerConn{handlerID: handlerID, handle: handle}
+	hc.conn = newConn(nc, hc.dispatch)
+	if err := subscribe(hc.conn, handlerID); err != nil {
+		hc.conn.Close()
+		return nil, err
+	}
+	return hc, nil
+}
+
+// Handler is implemented by whatever a handler wants to run behind a
+// DialHandler connection, to answer uplinks and joins pushed by the broker.
+type Handler interface {
+	HandleData(appEUI, devEUI string, payload []byte) (downlink []byte, err error)
+	HandleJoin(appEUI, devEUI string) (accept []byte, err error)
+}
+
+// HandlerConn is the handler-side endpoint of a jsonrpc adapter connection.
+type HandlerConn struct {
+	handlerID string
+	handle    Handler
+	conn      *conn
+}
+
+func (hc *HandlerConn) dispatch(c *conn, method string, params json.RawMessage) (interface{}, error) {
+	switch method {
+	case "Handler.HandleData":
+		var args handleDataArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, errors.New(errors.Structural, err)
+		}
+		downlink, err := hc.handle.HandleData(args.AppEUI, args.DevEUI, args.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return handleDataReply{Downlink: downlink}, nil
+
+	case "Handler.HandleJoin":
+		var args handleJoinArgs
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, errors.New(errors.Structural, err)
+		}
+		accept, err := hc.handle.HandleJoin(args.AppEUI, args.DevEUI)
+		if err != nil {
+			return nil, err
+		}
+		return handleJoinReply{Accept: accept}, nil
+
+	default:
+		return nil, errors.New(errors.Structural, "Unknown method: "+method)
+	}
+}
+
+// PushDownlink lets the handler proactively push a downlink for recipient,
+// e.g. for a class C device, outside of any uplink/HandleData round trip.
+func (hc *HandlerConn) PushDownlink(recipient, payload []byte) error {
+	return hc.conn.Call("Adapter.PushDownlink", pushDownlinkArgs{Recipient: recipient, Payload: payload}, nil)
+}
+
+func (hc *HandlerConn) Close() error {
+	return hc.conn.Close()
+}
+
+// Send implements core.Adapter. It forwards pkt to every recipient's
+// handler over its subscribed connection, returning the first downlink
+// reply it gets back, if any.
+func (a *Adapter) Send(pkt core.Packet, recipients ...core.Recipient) (core.Packet, error) {
+	hpacket, ok := pkt.(core.HPacket)
+	if !ok {
+		return nil, errors.New(errors.Structural, "jsonrpc adapter only forwards HPackets")
+	}
+
+	payload, err := hpacket.MarshalBinary()
+	if err != nil {
+		return nil, errors.New(errors.Structural, err)
+	}
+
+	var downlink core.Packet
+	for _, recipient := range recipients {
+		r, ok := recipient.(Recipient)
+		if !ok {
+			return nil, errors.New(errors.Structural, "Unsupported recipient type")
+		}
+
+		a.mu.RLock()
+		c, ok := a.handlers[r.HandlerID]
+		a.mu.RUnlock()
+		if !ok {
+			return nil, errors.New(errors.Behavioural, "Unknown handler: "+r.HandlerID)
+		}
+
+		var reply handleDataReply
+		args := handleDataArgs{
+			AppEUI:  hpacket.AppEUI().String(),
+			DevEUI:  hpacket.DevEUI().String(),
+			Payload: payload,
+		}
+		if err := c.Call("Handler.HandleData", args, &reply); err != nil {
+			return nil, errors.New(errors.Operational, err)
+		}
+		if len(reply.Downlink) > 0 && downlink == nil {
+			downlink = rawPacket(reply.Downlink)
+		}
+	}
+	return downlink, nil
+}
+
+// GetRecipient implements core.Adapter. raw is a handler ID rather than an
+// opaque transport address, so it resolves to a recipient directly.
+func (a *Adapter) GetRecipient(raw []byte) (core.Recipient, error) {
+	handlerID := string(raw)
+
+	a.mu.RLock()
+	_, ok := a.handlers[handlerID]
+	a.mu.RUnlock()
+	if !ok {
+		return nil, errors.New(errors.Behavioural, "Unknown handler: "+handlerID)
+	}
+	return Recipient{HandlerID: handlerID}, nil
+}
+
+// Next implements core.Adapter, surfacing downlinks handlers pushed
+// out-of-band through PushDownlink. It returns once the adapter is closed.
+func (a *Adapter) Next() (core.Packet, core.AckNacker, error) {
+	select {
+	case dl := <-a.downlinks:
+		return dl.packet, dl.an, nil
+	case <-a.closed:
+		return nil, nil, errors.New(errors.Operational, "Adapter closed")
+	}
+}
+
+// NextRegistration implements core.Adapter. This adapter doesn't carry
+// registrations of its own; handlers register through the usual channel. It
+// blocks until the adapter is closed, so Close can unblock a caller waiting
+// here for good.
+func (a *Adapter) NextRegistration() (core.Registration, core.AckNacker, error) {
+	<-a.closed
+	return nil, nil, errors.New(errors.Operational, "Adapter closed")
+}
+
+// rawPacket is a core.Packet around an already-marshaled frame, used for
+// payloads this adapter doesn't need to interpret any further.
+type rawPacket []byte
+
+func (p rawPacket) MarshalBinary() ([]byte, error)  { return []byte(p), nil }
+func (p *rawPacket) UnmarshalBinary(d []byte) error { *p = d; return nil }
+func (p rawPacket) Metadata() core.Metadata         { return core.Metadata{} }
+
+// ackNacker is a no-op AckNacker for packets originated locally by a
+// handler push rather than by a remote gateway.
+type ackNacker struct{}
+
+func (ackNacker) Ack() error  { return nil }
+func (ackNacker) Nack() error { return nil }
@@ -0,0 +1,143 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+// Package broker hosts the component responsible for routing validated
+// LoRaWAN uplinks from gateways to the right handler, and downlinks back.
+package broker
+
+import (
+	"github.com/TheThingsNetwork/ttn/core"
+	"github.com/TheThingsNetwork/ttn/utils/errors"
+	"github.com/apex/log"
+)
+
+// Broker validates incoming uplinks against registered devices and routes
+// them to the handler in charge of the associated application.
+type Broker struct {
+	Storage
+	replay       ReplayCache
+	interceptors []Interceptor
+	ctx          log.Interface
+}
+
+// Option customizes a Broker at construction time.
+type Option func(*Broker)
+
+// WithReplayCache overrides the default replay-protection cache, mainly so
+// tests can substitute a mock or a deterministic fake.
+func WithReplayCache(r ReplayCache) Option {
+	return func(b *Broker) {
+		b.replay = r
+	}
+}
+
+// New constructs a new Broker backed by the given storage.
+func New(s Storage, ctx log.Interface, opts ...Option) *Broker {
+	b := &Broker{
+		Storage: s,
+		replay:  NewReplayCache(defaultReplayTTL, defaultReplayWindow),
+		ctx:     ctx,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Register stores a new device or application registration.
+func (b *Broker) Register(reg core.Registration, an core.AckNacker) error {
+	var err error
+	switch r := reg.(type) {
+	case core.BRegistration:
+		err = b.StoreDevice(r)
+	case core.ARegistration:
+		err = b.StoreApplication(r)
+	default:
+		err = errors.New(errors.Structural, "Unreckognized registration type")
+	}
+
+	if err != nil {
+		an.Nack()
+		return err
+	}
+	return an.Ack()
+}
+
+// HandleUp validates a raw uplink frame, looks up the devices that could
+// have produced it, and forwards it to the handler responsible for the
+// matching device once its MIC has been verified.
+func (b *Broker) HandleUp(data []byte, an core.AckNacker, adapter core.Adapter) error {
+	packet := new(bpacket)
+	if err := packet.UnmarshalBinary(data); err != nil {
+		an.Nack()
+		return err
+	}
+
+	err := b.runChain(packet, func(pkt core.Packet) error {
+		return b.handleValidatedUp(pkt.(BPacket), adapter)
+	})
+	if err != nil {
+		an.Nack()
+		return err
+	}
+	return an.Ack()
+}
+
+// handleValidatedUp runs the MIC validation, replay check, and routing that
+// every uplink goes through once it has passed the interceptor chain.
+func (b *Broker) handleValidatedUp(packet BPacket, adapter core.Adapter) error {
+	var entries []devEntry
+	err := b.Update(func(tx Storage) error {
+		var err error
+		entries, err = tx.LookupDevices(packet.DevAddr())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var match *devEntry
+	for i := range entries {
+		ok, err := packet.ValidateMIC(entries[i].NwkSKey)
+		if err != nil {
+			return errors.New(errors.Structural, err)
+		}
+		if ok {
+			match = &entries[i]
+			break
+		}
+	}
+	if match == nil {
+		return errors.New(errors.Behavioural, "No device matches the given MIC")
+	}
+
+	if !b.replay.Seen(match.DevEUI, packet.FCnt()) {
+		b.ctx.WithField("devEUI", match.DevEUI).Warn("Rejected uplink, frame counter already seen")
+		return errors.New(errors.Behavioural, "Possible replay attack detected, frame counter already seen")
+	}
+
+	hpacket, err := core.NewHPacket(match.AppEUI, match.DevEUI, packet.Payload(), packet.Metadata())
+	if err != nil {
+		return errors.New(errors.Structural, err)
+	}
+
+	recipient, err := adapter.GetRecipient(match.Recipient)
+	if err != nil {
+		return errors.New(errors.Structural, err)
+	}
+
+	if _, err := adapter.Send(hpacket, recipient); err != nil {
+		return errors.New(errors.Operational, err)
+	}
+
+	return nil
+}
+
+// Close releases the Broker's background resources: the replay cache's
+// eviction goroutine and the underlying Storage.
+func (b *Broker) Close() error {
+	if err := b.replay.Close(); err != nil {
+		return err
+	}
+	return b.Storage.Close()
+}
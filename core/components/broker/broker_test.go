@@ -4,7 +4,9 @@
 package broker
 
 import (
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/TheThingsNetwork/ttn/core"
 	"github.com/TheThingsNetwork/ttn/core/mocks"
@@ -31,8 +33,8 @@ func TestRegister(t *testing.T) {
 		// Check
 		errutil.CheckErrors(t, nil, err)
 		mocks.CheckAcks(t, true, an.InAck)
-		CheckRegistrations(t, r, store.InStoreDevices)
-		CheckRegistrations(t, nil, store.InStoreApp)
+		checkRegistrations(t, r, store.InStoreDevices)
+		checkRegistrations(t, nil, store.InStoreApp)
 	}
 
 	// -------------------
@@ -52,8 +54,8 @@ func TestRegister(t *testing.T) {
 		// Check
 		errutil.CheckErrors(t, nil, err)
 		mocks.CheckAcks(t, true, an.InAck)
-		CheckRegistrations(t, nil, store.InStoreDevices)
-		CheckRegistrations(t, r, store.InStoreApp)
+		checkRegistrations(t, nil, store.InStoreDevices)
+		checkRegistrations(t, r, store.InStoreApp)
 	}
 
 	// -------------------
@@ -74,8 +76,8 @@ func TestRegister(t *testing.T) {
 		// Check
 		errutil.CheckErrors(t, pointer.String(string(errors.Structural)), err)
 		mocks.CheckAcks(t, false, an.InAck)
-		CheckRegistrations(t, r, store.InStoreDevices)
-		CheckRegistrations(t, nil, store.InStoreApp)
+		checkRegistrations(t, r, store.InStoreDevices)
+		checkRegistrations(t, nil, store.InStoreApp)
 	}
 
 	// -------------------
@@ -96,8 +98,8 @@ func TestRegister(t *testing.T) {
 		// Check
 		errutil.CheckErrors(t, pointer.String(string(errors.Structural)), err)
 		mocks.CheckAcks(t, false, an.InAck)
-		CheckRegistrations(t, nil, store.InStoreDevices)
-		CheckRegistrations(t, r, store.InStoreApp)
+		checkRegistrations(t, nil, store.InStoreDevices)
+		checkRegistrations(t, r, store.InStoreApp)
 	}
 
 	// -------------------
@@ -117,8 +119,8 @@ func TestRegister(t *testing.T) {
 		// Check
 		errutil.CheckErrors(t, pointer.String(string(errors.Structural)), err)
 		mocks.CheckAcks(t, false, an.InAck)
-		CheckRegistrations(t, nil, store.InStoreDevices)
-		CheckRegistrations(t, nil, store.InStoreApp)
+		checkRegistrations(t, nil, store.InStoreDevices)
+		checkRegistrations(t, nil, store.InStoreApp)
 	}
 }
 
@@ -145,8 +147,8 @@ func TestHandleUp(t *testing.T) {
 		// Check
 		errutil.CheckErrors(t, pointer.String(string(errors.Behavioural)), err)
 		mocks.CheckAcks(t, false, an.InAck)
-		CheckRegistrations(t, nil, store.InStoreDevices)
-		CheckRegistrations(t, nil, store.InStoreApp)
+		checkRegistrations(t, nil, store.InStoreDevices)
+		checkRegistrations(t, nil, store.InStoreApp)
 		mocks.CheckSent(t, nil, adapter.InSendPacket)
 		mocks.CheckRecipients(t, nil, adapter.InSendRecipients)
 	}
@@ -168,8 +170,8 @@ func TestHandleUp(t *testing.T) {
 		// Check
 		errutil.CheckErrors(t, pointer.String(string(errors.Structural)), err)
 		mocks.CheckAcks(t, false, an.InAck)
-		CheckRegistrations(t, nil, store.InStoreDevices)
-		CheckRegistrations(t, nil, store.InStoreApp)
+		checkRegistrations(t, nil, store.InStoreDevices)
+		checkRegistrations(t, nil, store.InStoreApp)
 		mocks.CheckSent(t, nil, adapter.InSendPacket)
 		mocks.CheckRecipients(t, nil, adapter.InSendRecipients)
 	}
@@ -211,8 +213,8 @@ func TestHandleUp(t *testing.T) {
 		// Check
 		errutil.CheckErrors(t, pointer.String(string(errors.Behavioural)), err)
 		mocks.CheckAcks(t, false, an.InAck)
-		CheckRegistrations(t, nil, store.InStoreDevices)
-		CheckRegistrations(t, nil, store.InStoreApp)
+		checkRegistrations(t, nil, store.InStoreDevices)
+		checkRegistrations(t, nil, store.InStoreApp)
 		mocks.CheckSent(t, nil, adapter.InSendPacket)
 		mocks.CheckRecipients(t, nil, adapter.InSendRecipients)
 	}
@@ -264,8 +266,8 @@ func TestHandleUp(t *testing.T) {
 		// Check
 		errutil.CheckErrors(t, nil, err)
 		mocks.CheckAcks(t, true, an.InAck)
-		CheckRegistrations(t, nil, store.InStoreDevices)
-		CheckRegistrations(t, nil, store.InStoreApp)
+		checkRegistrations(t, nil, store.InStoreDevices)
+		checkRegistrations(t, nil, store.InStoreApp)
 		mocks.CheckSent(t, hpacket, adapter.InSendPacket)
 		mocks.CheckRecipients(t, []core.Recipient{recipient}, adapter.InSendRecipients)
 	}
@@ -310,8 +312,8 @@ func TestHandleUp(t *testing.T) {
 		// Check
 		errutil.CheckErrors(t, pointer.String(string(errors.Structural)), err)
 		mocks.CheckAcks(t, false, an.InAck)
-		CheckRegistrations(t, nil, store.InStoreDevices)
-		CheckRegistrations(t, nil, store.InStoreApp)
+		checkRegistrations(t, nil, store.InStoreDevices)
+		checkRegistrations(t, nil, store.InStoreApp)
 		mocks.CheckSent(t, nil, adapter.InSendPacket)
 		mocks.CheckRecipients(t, nil, adapter.InSendRecipients)
 	}
@@ -363,9 +365,289 @@ func TestHandleUp(t *testing.T) {
 		// Check
 		errutil.CheckErrors(t, pointer.String(string(errors.Operational)), err)
 		mocks.CheckAcks(t, false, an.InAck)
-		CheckRegistrations(t, nil, store.InStoreDevices)
-		CheckRegistrations(t, nil, store.InStoreApp)
+		checkRegistrations(t, nil, store.InStoreDevices)
+		checkRegistrations(t, nil, store.InStoreApp)
 		mocks.CheckSent(t, hpacket, adapter.InSendPacket)
 		mocks.CheckRecipients(t, []core.Recipient{recipient}, adapter.InSendRecipients)
 	}
-}
\ No newline at end of file
+}
+
+func TestHandleUpReplay(t *testing.T) {
+	{
+		testutil.Desc(t, "Send the same packet twice, second is a replay")
+
+		// Build
+		an := mocks.NewMockAckNacker()
+		recipient := mocks.NewMockRecipient()
+		adapter := mocks.NewMockAdapter()
+		adapter.OutSend = nil
+		adapter.OutGetRecipient = recipient
+		store := newMockStorage()
+		store.OutLookupDevices = []devEntry{
+			{
+				Recipient: []byte{1, 2, 3},
+				AppEUI:    lorawan.EUI64([8]byte{1, 1, 1, 1, 5, 5, 5, 5}),
+				DevEUI:    lorawan.EUI64([8]byte{4, 4, 4, 4, 2, 3, 2, 3}),
+				NwkSKey:   lorawan.AES128Key([16]byte{1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8}),
+			},
+		}
+		data, _ := newBPacket(
+			[4]byte{2, 3, 2, 3},
+			"Payload",
+			[16]byte{1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8},
+			5,
+		).MarshalBinary()
+
+		// Operate
+		broker := New(store, testutil.GetLogger(t, "Broker"))
+		err1 := broker.HandleUp(data, an, adapter)
+		err2 := broker.HandleUp(data, an, adapter)
+
+		// Check
+		errutil.CheckErrors(t, nil, err1)
+		errutil.CheckErrors(t, pointer.String(string(errors.Behavioural)), err2)
+	}
+
+	// -------------------
+
+	{
+		testutil.Desc(t, "Send the same FCnt twice through a replay cache given with WithReplayCache")
+
+		// Build
+		an := mocks.NewMockAckNacker()
+		recipient := mocks.NewMockRecipient()
+		adapter := mocks.NewMockAdapter()
+		adapter.OutSend = nil
+		adapter.OutGetRecipient = recipient
+		store := newMockStorage()
+		store.OutLookupDevices = []devEntry{
+			{
+				Recipient: []byte{1, 2, 3},
+				AppEUI:    lorawan.EUI64([8]byte{1, 1, 1, 1, 5, 5, 5, 5}),
+				DevEUI:    lorawan.EUI64([8]byte{4, 4, 4, 4, 2, 3, 2, 3}),
+				NwkSKey:   lorawan.AES128Key([16]byte{1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8}),
+			},
+		}
+		data, _ := newBPacket(
+			[4]byte{2, 3, 2, 3},
+			"Payload",
+			[16]byte{1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8},
+			5,
+		).MarshalBinary()
+
+		// Operate
+		broker := New(store, testutil.GetLogger(t, "Broker"), WithReplayCache(NewReplayCache(time.Minute, 0)))
+		err1 := broker.HandleUp(data, an, adapter)
+		err2 := broker.HandleUp(data, an, adapter)
+
+		// Check
+		errutil.CheckErrors(t, nil, err1)
+		errutil.CheckErrors(t, pointer.String(string(errors.Behavioural)), err2)
+	}
+
+	// -------------------
+
+	{
+		testutil.Desc(t, "Tolerate a reordered frame within the window, still reject the exact replay")
+
+		// Build
+		an := mocks.NewMockAckNacker()
+		recipient := mocks.NewMockRecipient()
+		adapter := mocks.NewMockAdapter()
+		adapter.OutSend = nil
+		adapter.OutGetRecipient = recipient
+		store := newMockStorage()
+		store.OutLookupDevices = []devEntry{
+			{
+				Recipient: []byte{1, 2, 3},
+				AppEUI:    lorawan.EUI64([8]byte{1, 1, 1, 1, 5, 5, 5, 5}),
+				DevEUI:    lorawan.EUI64([8]byte{4, 4, 4, 4, 2, 3, 2, 3}),
+				NwkSKey:   lorawan.AES128Key([16]byte{1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8}),
+			},
+		}
+		devAddr := [4]byte{2, 3, 2, 3}
+		nwkSKey := [16]byte{1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8}
+		dataHigh, _ := newBPacket(devAddr, "Payload", nwkSKey, 10).MarshalBinary()
+		dataReordered, _ := newBPacket(devAddr, "Payload", nwkSKey, 8).MarshalBinary()
+		dataReplay, _ := newBPacket(devAddr, "Payload", nwkSKey, 10).MarshalBinary()
+
+		// Operate
+		broker := New(store, testutil.GetLogger(t, "Broker"), WithReplayCache(NewReplayCache(time.Minute, 5)))
+		errHigh := broker.HandleUp(dataHigh, an, adapter)
+		errReordered := broker.HandleUp(dataReordered, an, adapter)
+		errReplay := broker.HandleUp(dataReplay, an, adapter)
+
+		// Check
+		errutil.CheckErrors(t, nil, errHigh)
+		errutil.CheckErrors(t, nil, errReordered)
+		errutil.CheckErrors(t, pointer.String(string(errors.Behavioural)), errReplay)
+	}
+
+	// -------------------
+
+	{
+		testutil.Desc(t, "Replay protection is keyed per device, not per DevAddr")
+
+		// Build
+		an := mocks.NewMockAckNacker()
+		recipient := mocks.NewMockRecipient()
+		adapter := mocks.NewMockAdapter()
+		adapter.OutSend = nil
+		adapter.OutGetRecipient = recipient
+		store := newMockStorage()
+		devAddr := [4]byte{2, 3, 2, 3}
+		nwkSKeyA := [16]byte{1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8}
+		nwkSKeyB := [16]byte{9, 9, 8, 8, 7, 7, 6, 6, 5, 5, 4, 4, 3, 3, 2, 2}
+		store.OutLookupDevices = []devEntry{
+			{
+				Recipient: []byte{1, 2, 3},
+				AppEUI:    lorawan.EUI64([8]byte{1, 1, 1, 1, 5, 5, 5, 5}),
+				DevEUI:    lorawan.EUI64([8]byte{4, 4, 4, 4, 2, 3, 2, 3}),
+				NwkSKey:   lorawan.AES128Key(nwkSKeyA),
+			},
+			{
+				Recipient: []byte{1, 2, 3},
+				AppEUI:    lorawan.EUI64([8]byte{2, 2, 2, 2, 6, 6, 6, 6}),
+				DevEUI:    lorawan.EUI64([8]byte{5, 5, 5, 5, 3, 4, 3, 4}),
+				NwkSKey:   lorawan.AES128Key(nwkSKeyB),
+			},
+		}
+		dataA, _ := newBPacket(devAddr, "Payload", nwkSKeyA, 9).MarshalBinary()
+		dataB, _ := newBPacket(devAddr, "Payload", nwkSKeyB, 9).MarshalBinary()
+
+		// Operate
+		broker := New(store, testutil.GetLogger(t, "Broker"))
+		errA := broker.HandleUp(dataA, an, adapter)
+		errB := broker.HandleUp(dataB, an, adapter)
+
+		// Check: both devices use the same FCnt on the same DevAddr, and
+		// neither should be rejected as a replay of the other.
+		errutil.CheckErrors(t, nil, errA)
+		errutil.CheckErrors(t, nil, errB)
+	}
+}
+
+func TestBrokerInterceptors(t *testing.T) {
+	{
+		testutil.Desc(t, "Interceptors run in registration order")
+
+		// Build
+		an := mocks.NewMockAckNacker()
+		recipient := mocks.NewMockRecipient()
+		adapter := mocks.NewMockAdapter()
+		adapter.OutSend = nil
+		adapter.OutGetRecipient = recipient
+		store := newMockStorage()
+		store.OutLookupDevices = []devEntry{
+			{
+				Recipient: []byte{1, 2, 3},
+				AppEUI:    lorawan.EUI64([8]byte{1, 1, 1, 1, 5, 5, 5, 5}),
+				DevEUI:    lorawan.EUI64([8]byte{4, 4, 4, 4, 2, 3, 2, 3}),
+				NwkSKey:   lorawan.AES128Key([16]byte{1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8}),
+			},
+		}
+		data, _ := newBPacket(
+			[4]byte{2, 3, 2, 3},
+			"Payload",
+			[16]byte{1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8},
+			5,
+		).MarshalBinary()
+		var order []string
+
+		// Operate
+		broker := New(store, testutil.GetLogger(t, "Broker"))
+		broker.Use(func(pkt core.Packet, next func(core.Packet) error) error {
+			order = append(order, "first")
+			return next(pkt)
+		})
+		broker.Use(func(pkt core.Packet, next func(core.Packet) error) error {
+			order = append(order, "second")
+			return next(pkt)
+		})
+		err := broker.HandleUp(data, an, adapter)
+
+		// Check
+		errutil.CheckErrors(t, nil, err)
+		if !reflect.DeepEqual(order, []string{"first", "second"}) {
+			t.Errorf("Expected interceptors to run in registration order, got: %v", order)
+		}
+	}
+
+	// -------------------
+
+	{
+		testutil.Desc(t, "An interceptor can short-circuit the chain")
+
+		// Build
+		an := mocks.NewMockAckNacker()
+		adapter := mocks.NewMockAdapter()
+		store := newMockStorage()
+		data, _ := newBPacket(
+			[4]byte{2, 3, 2, 3},
+			"Payload",
+			[16]byte{1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8},
+			5,
+		).MarshalBinary()
+
+		// Operate
+		broker := New(store, testutil.GetLogger(t, "Broker"))
+		broker.Use(func(pkt core.Packet, next func(core.Packet) error) error {
+			return errors.New(errors.Behavioural, "Rejected by interceptor")
+		})
+		err := broker.HandleUp(data, an, adapter)
+
+		// Check
+		errutil.CheckErrors(t, pointer.String(string(errors.Behavioural)), err)
+		mocks.CheckAcks(t, false, an.InAck)
+		mocks.CheckSent(t, nil, adapter.InSendPacket)
+	}
+
+	// -------------------
+
+	{
+		testutil.Desc(t, "An interceptor can rewrite metadata before the MIC check")
+
+		// Build
+		an := mocks.NewMockAckNacker()
+		recipient := mocks.NewMockRecipient()
+		adapter := mocks.NewMockAdapter()
+		adapter.OutSend = nil
+		adapter.OutGetRecipient = recipient
+		store := newMockStorage()
+		store.OutLookupDevices = []devEntry{
+			{
+				Recipient: []byte{1, 2, 3},
+				AppEUI:    lorawan.EUI64([8]byte{1, 1, 1, 1, 5, 5, 5, 5}),
+				DevEUI:    lorawan.EUI64([8]byte{4, 4, 4, 4, 2, 3, 2, 3}),
+				NwkSKey:   lorawan.AES128Key([16]byte{1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8}),
+			},
+		}
+		packet := newBPacket(
+			[4]byte{2, 3, 2, 3},
+			"Payload",
+			[16]byte{1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8},
+			5,
+		)
+		data, _ := packet.MarshalBinary()
+		rewritten := core.Metadata{DataRate: "SF7BW125"}
+		hpacket, _ := core.NewHPacket(
+			store.OutLookupDevices[0].AppEUI,
+			store.OutLookupDevices[0].DevEUI,
+			packet.Payload(),
+			rewritten,
+		)
+
+		// Operate
+		broker := New(store, testutil.GetLogger(t, "Broker"))
+		broker.Use(func(pkt core.Packet, next func(core.Packet) error) error {
+			bp := pkt.(*bpacket)
+			bp.metadata = rewritten
+			return next(bp)
+		})
+		err := broker.HandleUp(data, an, adapter)
+
+		// Check
+		errutil.CheckErrors(t, nil, err)
+		mocks.CheckSent(t, hpacket, adapter.InSendPacket)
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package broker
+
+import "github.com/TheThingsNetwork/ttn/core"
+
+// Interceptor is a middleware hook that runs in front of HandleUp's packet
+// handling. It receives the incoming packet and a next function to continue
+// the chain; not calling next short-circuits the request with the returned
+// error. Register doesn't go through the chain: it deals in registrations,
+// not packets, so there's nothing of this shape to intercept there.
+type Interceptor func(pkt core.Packet, next func(core.Packet) error) error
+
+// Use registers an Interceptor. Interceptors run in the order they were
+// registered, wrapped around HandleUp's MIC validation and store lookup, so
+// they can rate-limit, audit, or rewrite packets before those run.
+func (b *Broker) Use(i Interceptor) {
+	b.interceptors = append(b.interceptors, i)
+}
+
+// runChain threads pkt through every registered interceptor before handing
+// it to terminal, the broker's own handling logic.
+func (b *Broker) runChain(pkt core.Packet, terminal func(core.Packet) error) error {
+	next := terminal
+	for i := len(b.interceptors) - 1; i >= 0; i-- {
+		interceptor := b.interceptors[i]
+		wrapped := next
+		next = func(p core.Packet) error {
+			return interceptor(p, wrapped)
+		}
+	}
+	return next(pkt)
+}
@@ -0,0 +1,78 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package broker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/TheThingsNetwork/ttn/core"
+	"github.com/brocaar/lorawan"
+)
+
+// checkRegistrations asserts a registration was (or was not) forwarded to
+// storage as expected. It's used by broker_test.go.
+func checkRegistrations(t *testing.T, want, got core.Registration) {
+	if want == nil {
+		if got != nil {
+			t.Errorf("Expected no registration but got: %v", got)
+		}
+		return
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected registration %v but got %v", want, got)
+	}
+}
+
+// mockStorage is an in-memory storage stub that records its calls, in the
+// same spirit as the mocks found under core/mocks.
+type mockStorage struct {
+	Failures map[string]error
+
+	InStoreDevices core.Registration
+	InStoreApp     core.Registration
+
+	OutLookupDevices []devEntry
+}
+
+func newMockStorage() *mockStorage {
+	return &mockStorage{
+		Failures: make(map[string]error),
+	}
+}
+
+func (s *mockStorage) StoreDevice(r core.BRegistration) error {
+	s.InStoreDevices = r
+	if err, ok := s.Failures["StoreDevice"]; ok {
+		return err
+	}
+	return nil
+}
+
+func (s *mockStorage) StoreApplication(r core.ARegistration) error {
+	s.InStoreApp = r
+	if err, ok := s.Failures["StoreApplication"]; ok {
+		return err
+	}
+	return nil
+}
+
+func (s *mockStorage) LookupDevices(devAddr lorawan.DevAddr) ([]devEntry, error) {
+	if err, ok := s.Failures["LookupDevices"]; ok {
+		return nil, err
+	}
+	return s.OutLookupDevices, nil
+}
+
+func (s *mockStorage) Update(fn func(Storage) error) error {
+	return fn(s)
+}
+
+func (s *mockStorage) Batch(fn func(Storage) error) error {
+	return fn(s)
+}
+
+func (s *mockStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package broker
+
+import (
+	"github.com/TheThingsNetwork/ttn/core"
+	"github.com/TheThingsNetwork/ttn/utils/errors"
+	"github.com/brocaar/lorawan"
+)
+
+// BPacket is the packet exchanged between a gateway (through an adapter) and
+// a broker. It carries a raw, not-yet-validated LoRaWAN uplink frame.
+type BPacket interface {
+	core.Packet
+	DevAddr() lorawan.DevAddr
+	FCnt() uint32
+	ValidateMIC(key lorawan.AES128Key) (bool, error)
+}
+
+type bpacket struct {
+	payload  lorawan.PHYPayload
+	metadata core.Metadata
+}
+
+// newBPacket constructs a BPacket from its plain components. It's mostly
+// used to generate test fixtures; real packets reach the broker already
+// marshaled from a gateway adapter and are rebuilt with UnmarshalBinary.
+func newBPacket(devAddr [4]byte, payload string, nwkSKey [16]byte, fcnt uint32) BPacket {
+	macPayload := lorawan.NewMACPayload(true)
+	macPayload.FHDR = lorawan.FHDR{
+		DevAddr: lorawan.DevAddr(devAddr),
+		FCnt:    fcnt,
+	}
+	macPayload.FPort = 1
+	macPayload.FRMPayload = []lorawan.Payload{&lorawan.DataPayload{Bytes: []byte(payload)}}
+
+	phy := lorawan.NewPHYPayload(true)
+	phy.MHDR = lorawan.MHDR{
+		MType: lorawan.UnconfirmedDataUp,
+		Major: lorawan.LoRaWANR1,
+	}
+	phy.MACPayload = macPayload
+	_ = phy.SetMIC(lorawan.AES128Key(nwkSKey))
+
+	return &bpacket{payload: phy}
+}
+
+// MarshalBinary implements the core.Packet interface.
+func (p *bpacket) MarshalBinary() ([]byte, error) {
+	return p.payload.MarshalBinary()
+}
+
+// UnmarshalBinary implements the core.Packet interface.
+func (p *bpacket) UnmarshalBinary(data []byte) error {
+	phy := lorawan.NewPHYPayload(true)
+	if err := phy.UnmarshalBinary(data); err != nil {
+		return errors.New(errors.Structural, err)
+	}
+	if _, ok := phy.MACPayload.(*lorawan.MACPayload); !ok {
+		return errors.New(errors.Structural, "Invalid MACPayload")
+	}
+	p.payload = phy
+	return nil
+}
+
+// Metadata implements the core.Packet interface.
+func (p *bpacket) Metadata() core.Metadata {
+	return p.metadata
+}
+
+// Payload returns the raw application payload carried by the frame.
+func (p *bpacket) Payload() []byte {
+	macPayload, ok := p.payload.MACPayload.(*lorawan.MACPayload)
+	if !ok || len(macPayload.FRMPayload) == 0 {
+		return nil
+	}
+	data, _ := macPayload.FRMPayload[0].MarshalBinary()
+	return data
+}
+
+// DevAddr returns the device address carried in the frame header.
+func (p *bpacket) DevAddr() lorawan.DevAddr {
+	macPayload := p.payload.MACPayload.(*lorawan.MACPayload)
+	return macPayload.FHDR.DevAddr
+}
+
+// FCnt returns the frame counter carried in the frame header.
+func (p *bpacket) FCnt() uint32 {
+	macPayload := p.payload.MACPayload.(*lorawan.MACPayload)
+	return macPayload.FHDR.FCnt
+}
+
+// ValidateMIC checks the packet's MIC against the given network session key.
+func (p *bpacket) ValidateMIC(key lorawan.AES128Key) (bool, error) {
+	return p.payload.ValidateMIC(key)
+}
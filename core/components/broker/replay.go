@@ -0,0 +1,150 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/brocaar/lorawan"
+)
+
+// defaultReplayTTL is how long a (DevEUI, FCnt) entry is kept around before
+// the background janitor reclaims it.
+const defaultReplayTTL = 1 * time.Hour
+
+// defaultReplayWindow is how far behind the highest seen counter an incoming
+// FCnt is still allowed to be, to tolerate uplinks arriving out of order.
+const defaultReplayWindow = 0
+
+// maxReplayWindow is the largest window a ReplayCache can track, since each
+// device's recently-seen counters are kept in a single uint64 bitmap.
+const maxReplayWindow = 63
+
+// ReplayCache tracks, per device, which of the most recently seen frame
+// counters have already been accepted, so the broker can reject replayed or
+// duplicate uplinks. Implementations must be safe for concurrent use.
+type ReplayCache interface {
+	// Seen reports whether fcnt is acceptable for the device identified by
+	// devEUI given the counters already observed, and records it when it
+	// is. devEUI, not DevAddr, identifies the device: several devices can
+	// collide on the same DevAddr, and each must get its own counter.
+	// Seen returns false when fcnt has already been accepted, whether it
+	// is the current highest counter or one of the reordered frames
+	// tolerated within the window.
+	Seen(devEUI lorawan.EUI64, fcnt uint32) bool
+
+	// Close stops the cache's background eviction and releases its
+	// resources. It does not need to be called more than once.
+	Close() error
+}
+
+// replayEntry tracks the highest FCnt seen for a device and which of the
+// window counters below it have also been seen, so a reordered-but-tolerated
+// frame can still be told apart from an exact replay of it. seenMask's bit i
+// is set when fcnt-i has been accepted.
+type replayEntry struct {
+	fcnt     uint32
+	seenMask uint64
+	seenAt   time.Time
+}
+
+// memReplayCache is a mutex-guarded, TTL-evicted ReplayCache, in the same
+// spirit as the preimage caches found elsewhere in the Go ecosystem.
+type memReplayCache struct {
+	mu      sync.Mutex
+	entries map[lorawan.EUI64]replayEntry
+	ttl     time.Duration
+	window  uint32
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewReplayCache creates a ReplayCache that evicts entries older than ttl
+// and tolerates uplinks reordered by up to window frame counters. window is
+// capped at maxReplayWindow.
+func NewReplayCache(ttl time.Duration, window uint32) ReplayCache {
+	if window > maxReplayWindow {
+		window = maxReplayWindow
+	}
+	c := &memReplayCache{
+		entries: make(map[lorawan.EUI64]replayEntry),
+		ttl:     ttl,
+		window:  window,
+		done:    make(chan struct{}),
+	}
+	go c.janitor()
+	return c
+}
+
+func (c *memReplayCache) Seen(devEUI lorawan.EUI64, fcnt uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[devEUI]
+	if !ok {
+		c.entries[devEUI] = replayEntry{fcnt: fcnt, seenMask: 1, seenAt: time.Now()}
+		return true
+	}
+
+	switch {
+	case fcnt > entry.fcnt:
+		shift := fcnt - entry.fcnt
+		if shift > maxReplayWindow {
+			entry.seenMask = 0
+		} else {
+			entry.seenMask <<= shift
+		}
+		entry.seenMask |= 1
+		entry.fcnt = fcnt
+
+	case fcnt == entry.fcnt:
+		// Exact replay of the highest frame seen so far.
+		return false
+
+	default:
+		back := entry.fcnt - fcnt
+		if back > c.window {
+			return false
+		}
+		bit := uint64(1) << back
+		if entry.seenMask&bit != 0 {
+			// Already accepted this reordered counter once.
+			return false
+		}
+		entry.seenMask |= bit
+	}
+
+	entry.seenAt = time.Now()
+	c.entries[devEUI] = entry
+	return true
+}
+
+func (c *memReplayCache) janitor() {
+	ticker := time.NewTicker(c.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cutoff := time.Now().Add(-c.ttl)
+			c.mu.Lock()
+			for devEUI, entry := range c.entries {
+				if entry.seenAt.Before(cutoff) {
+					delete(c.entries, devEUI)
+				}
+			}
+			c.mu.Unlock()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *memReplayCache) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package broker
+
+import (
+	"sync"
+
+	"github.com/TheThingsNetwork/ttn/core"
+	"github.com/TheThingsNetwork/ttn/utils/errors"
+	"github.com/brocaar/lorawan"
+)
+
+// devEntry gathers the routing information the broker keeps about a
+// registered device.
+type devEntry struct {
+	Recipient []byte
+	AppEUI    lorawan.EUI64
+	DevEUI    lorawan.EUI64
+	NwkSKey   lorawan.AES128Key
+}
+
+// Storage gives the broker access to the device and application
+// registrations it needs to route uplinks and downlinks. Implementations
+// must be safe for concurrent use.
+type Storage interface {
+	StoreDevice(r core.BRegistration) error
+	StoreApplication(r core.ARegistration) error
+	LookupDevices(devAddr lorawan.DevAddr) ([]devEntry, error)
+
+	// Update runs fn against a consistent snapshot of the store, so a
+	// caller that issues several lookups (e.g. HandleUp resolving a
+	// DevAddr collision) never observes a registration being written
+	// halfway through.
+	Update(fn func(Storage) error) error
+
+	// Batch runs fn in the same way as Update, but signals that fn only
+	// writes (as opposed to reading-then-writing), which implementations
+	// backed by a real transactional store can use to relax locking.
+	Batch(fn func(Storage) error) error
+
+	Close() error
+}
+
+// memStorage is a volatile, in-memory Storage implementation. It's a
+// reasonable default for single-process deployments that don't need state
+// to survive restarts.
+type memStorage struct {
+	mu      sync.RWMutex
+	devices map[lorawan.DevAddr][]devEntry
+	apps    []core.ARegistration
+}
+
+// NewStorage creates a fresh in-memory Storage.
+func NewStorage() Storage {
+	return &memStorage{
+		devices: make(map[lorawan.DevAddr][]devEntry),
+	}
+}
+
+func (s *memStorage) StoreDevice(r core.BRegistration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.storeDevice(r)
+}
+
+func (s *memStorage) storeDevice(r core.BRegistration) error {
+	s.devices[r.DevAddr()] = append(s.devices[r.DevAddr()], devEntry{
+		Recipient: r.Recipient(),
+		AppEUI:    r.AppEUI(),
+		DevEUI:    r.DevEUI(),
+		NwkSKey:   r.NwkSKey(),
+	})
+	return nil
+}
+
+func (s *memStorage) StoreApplication(r core.ARegistration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.storeApplication(r)
+}
+
+func (s *memStorage) storeApplication(r core.ARegistration) error {
+	s.apps = append(s.apps, r)
+	return nil
+}
+
+func (s *memStorage) LookupDevices(devAddr lorawan.DevAddr) ([]devEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lookupDevices(devAddr)
+}
+
+func (s *memStorage) lookupDevices(devAddr lorawan.DevAddr) ([]devEntry, error) {
+	entries, ok := s.devices[devAddr]
+	if !ok {
+		return nil, errors.New(errors.Behavioural, "Device not found")
+	}
+	return entries, nil
+}
+
+// Update takes the store's write lock for the whole transaction and hands
+// fn a view whose methods operate directly on the locked store, so nested
+// calls don't try to re-acquire the lock.
+func (s *memStorage) Update(fn func(Storage) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fn(&memStorageTx{s})
+}
+
+// Batch takes the store's write lock for the whole transaction, exactly
+// like Update. memStorage has no read-only/read-write transaction split to
+// exploit, so the two are equivalent here.
+func (s *memStorage) Batch(fn func(Storage) error) error {
+	return s.Update(fn)
+}
+
+func (s *memStorage) Close() error {
+	return nil
+}
+
+// memStorageTx is the Storage view handed to a memStorage.Update callback.
+type memStorageTx struct {
+	s *memStorage
+}
+
+func (tx *memStorageTx) StoreDevice(r core.BRegistration) error      { return tx.s.storeDevice(r) }
+func (tx *memStorageTx) StoreApplication(r core.ARegistration) error { return tx.s.storeApplication(r) }
+func (tx *memStorageTx) LookupDevices(devAddr lorawan.DevAddr) ([]devEntry, error) {
+	return tx.s.lookupDevices(devAddr)
+}
+func (tx *memStorageTx) Update(fn func(Storage) error) error { return fn(tx) }
+func (tx *memStorageTx) Batch(fn func(Storage) error) error  { return fn(tx) }
+func (tx *memStorageTx) Close() error                        { return nil }
@@ -0,0 +1,171 @@
+// Copyright © 2015 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package broker
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/core"
+	"github.com/TheThingsNetwork/ttn/utils/errors"
+	"github.com/boltdb/bolt"
+	"github.com/brocaar/lorawan"
+)
+
+var (
+	devicesBucket = []byte("devices")
+	appsBucket    = []byte("applications")
+)
+
+// boltStorage is a Storage implementation backed by a BoltDB file, so
+// broker state (device registrations, NwkSKey, recipient routing) survives
+// restarts.
+type boltStorage struct {
+	db *bolt.DB
+}
+
+// NewBoltStorage opens (creating if needed) a BoltDB-backed Storage at path.
+func NewBoltStorage(path string) (Storage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.New(errors.Operational, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(devicesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(appsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, errors.New(errors.Operational, err)
+	}
+
+	return &boltStorage{db: db}, nil
+}
+
+func (s *boltStorage) StoreDevice(r core.BRegistration) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltStoreDevice(tx, r)
+	})
+}
+
+func boltStoreDevice(tx *bolt.Tx, r core.BRegistration) error {
+	devAddr := r.DevAddr()
+	// No value under this DevAddr just means no device is registered
+	// there yet; start from an empty slice in that case.
+	var entries []devEntry
+	if tx.Bucket(devicesBucket).Get(devAddr[:]) != nil {
+		found, err := boltLookupDevices(tx, devAddr)
+		if err != nil {
+			return err
+		}
+		entries = found
+	}
+	entries = append(entries, devEntry{
+		Recipient: r.Recipient(),
+		AppEUI:    r.AppEUI(),
+		DevEUI:    r.DevEUI(),
+		NwkSKey:   r.NwkSKey(),
+	})
+	return boltPutDevices(tx, devAddr, entries)
+}
+
+func (s *boltStorage) StoreApplication(r core.ARegistration) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltStoreApplication(tx, r)
+	})
+}
+
+// appEntry is the concrete, gob-encodable counterpart to a
+// core.ARegistration: gob can't encode an interface value without a
+// gob.Register of its concrete type, so application registrations are
+// flattened to this DTO before being written, the same way devEntry does
+// for device registrations.
+type appEntry struct {
+	Recipient []byte
+	AppEUI    lorawan.EUI64
+}
+
+func boltStoreApplication(tx *bolt.Tx, r core.ARegistration) error {
+	var buf bytes.Buffer
+	entry := appEntry{Recipient: r.Recipient(), AppEUI: r.AppEUI()}
+	if err := gob.NewEncoder(&buf).Encode(&entry); err != nil {
+		return errors.New(errors.Structural, err)
+	}
+	return tx.Bucket(appsBucket).Put([]byte(r.AppEUI().String()), buf.Bytes())
+}
+
+func (s *boltStorage) LookupDevices(devAddr lorawan.DevAddr) ([]devEntry, error) {
+	var entries []devEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found, err := boltLookupDevices(tx, devAddr)
+		entries = found
+		return err
+	})
+	return entries, err
+}
+
+func boltLookupDevices(tx *bolt.Tx, devAddr lorawan.DevAddr) ([]devEntry, error) {
+	raw := tx.Bucket(devicesBucket).Get(devAddr[:])
+	if raw == nil {
+		return nil, errors.New(errors.Behavioural, "Device not found")
+	}
+	var entries []devEntry
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&entries); err != nil {
+		return nil, errors.New(errors.Structural, err)
+	}
+	return entries, nil
+}
+
+func boltPutDevices(tx *bolt.Tx, devAddr lorawan.DevAddr, entries []devEntry) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&entries); err != nil {
+		return errors.New(errors.Structural, err)
+	}
+	return tx.Bucket(devicesBucket).Put(devAddr[:], buf.Bytes())
+}
+
+// Update runs fn against a single BoltDB read-write transaction, so a
+// caller that issues several lookups sees a consistent snapshot of the
+// store.
+func (s *boltStorage) Update(fn func(Storage) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltStorageTx{tx})
+	})
+}
+
+// Batch runs fn through BoltDB's own Batch, which may combine it with other
+// concurrent, write-only transactions into a single disk commit. Use Update
+// instead when fn also needs to read what it or a concurrent writer wrote.
+func (s *boltStorage) Batch(fn func(Storage) error) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		return fn(&boltStorageTx{tx})
+	})
+}
+
+func (s *boltStorage) Close() error {
+	return s.db.Close()
+}
+
+// boltStorageTx is the Storage view handed to a boltStorage.Update callback.
+type boltStorageTx struct {
+	tx *bolt.Tx
+}
+
+func (s *boltStorageTx) StoreDevice(r core.BRegistration) error { return boltStoreDevice(s.tx, r) }
+
+func (s *boltStorageTx) StoreApplication(r core.ARegistration) error {
+	return boltStoreApplication(s.tx, r)
+}
+
+func (s *boltStorageTx) LookupDevices(devAddr lorawan.DevAddr) ([]devEntry, error) {
+	return boltLookupDevices(s.tx, devAddr)
+}
+
+func (s *boltStorageTx) Update(fn func(Storage) error) error { return fn(s) }
+func (s *boltStorageTx) Batch(fn func(Storage) error) error  { return fn(s) }
+func (s *boltStorageTx) Close() error                        { return nil }